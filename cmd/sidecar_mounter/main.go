@@ -40,6 +40,19 @@ var (
 	gcsfusePath    = flag.String("gcsfuse-path", "/gcsfuse", "gcsfuse path")
 	volumeBasePath = flag.String("volume-base-path", "/gcsfuse-tmp/.volumes", "volume base path")
 	gracePeriod    = flag.Int("grace-period", 30, "grace period for gcsfuse termination")
+	apiSocketPath  = flag.String("api-socket-path", "/gcsfuse-tmp/.sidecar.sock", "unix domain socket path the sidecar HTTP API listens on")
+	// Defaults to true. This sidecar binary can serve its API over a
+	// SO_PEERCRED-authorized unix socket, but the CSI node driver caller
+	// that POSTs to http://<pod-ip>:8080/mount is out of tree and was not
+	// updated to dial it as part of this change, so flipping this default
+	// would break every /mount, /reload, /unmount, and /cache/prune call
+	// in every deployment. Until the node driver is updated to dial
+	// -api-socket-path, the unauthenticated TCP listener stays the
+	// default and the privilege-escalation surface this flag exists to
+	// close remains open unless an operator opts in with
+	// -enable-tcp-api=false.
+	enableTCPAPI  = flag.Bool("enable-tcp-api", true, "serve the sidecar HTTP API over TCP :8080 instead of the SO_PEERCRED-authorized unix domain socket; disable only after the CSI node driver has been updated to dial the unix socket")
+	nodeDriverUID = flag.Int("node-driver-uid", 0, "additional UID, alongside UID 0, allowed to call the sidecar HTTP API over the unix socket")
 	// This is set at compile time.
 	version = "unknown"
 )
@@ -54,11 +67,29 @@ func main() {
 	if err != nil {
 		klog.Fatalf("failed to look up socket paths: %v", err)
 	}
-	mounter := sidecarmounter.New(*gcsfusePath)
+	mounter := sidecarmounter.New(*gcsfusePath, time.Duration(*gracePeriod)*time.Second)
+	metricsCollector := sidecarmounter.NewMetricsCollector(mounter)
 	server := &http.Server{
-		Addr:    ":8080",
 		Handler: http.DefaultServeMux,
 	}
+
+	apiListener, err := newAPIListener()
+	if err != nil {
+		klog.Fatalf("failed to set up the sidecar API listener: %v", err)
+	}
+
+	http.DefaultServeMux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metricsCollector.WriteMetrics(w)
+	}))
+
+	http.DefaultServeMux.Handle("/volumes", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(metricsCollector.VolumeStatuses()); err != nil {
+			klog.Errorf("failed to encode volume statuses: %v", err)
+			http.Error(w, fmt.Sprintf("failed to encode volume statuses: %v", err), http.StatusInternalServerError)
+		}
+	}))
+
 	http.DefaultServeMux.Handle("/mount", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		type MountRequest struct {
 			VolumeName   string `json:"volumeName"`
@@ -87,50 +118,65 @@ func main() {
 			}
 			mountConfig.ErrWriter = errWriter
 
-			go func(mc *sidecarmounter.MountConfig) {
-				if cmd, ok := mounter.GetCmds()[mountRequest.VolumeName]; ok {
-					klog.V(4).Infof("killing existing gcsfuse process: %v", cmd)
-					err := cmd.Process.Kill()
-					if err != nil {
-						klog.Errorf("failed to kill process %v with error: %v", cmd, err)
-					}
-				}
-				cmd, err := mounter.Mount(mc)
-				if err != nil {
-					errMsg := fmt.Sprintf("failed to mount bucket %q for volume %q: %v\n", mc.BucketName, mc.VolumeName, err)
-					klog.Errorf(errMsg)
-					if _, e := errWriter.Write([]byte(errMsg)); e != nil {
-						klog.Errorf("failed to write the error message %q: %v", errMsg, e)
-					}
+			go runGcsfuse(mounter, mountConfig, errWriter, mounter.Mount)
+		}
+		return
+	}))
 
-					return
+	http.DefaultServeMux.Handle("/reload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type ReloadRequest struct {
+			VolumeName   string `json:"volumeName"`
+			ObjectPrefix string `json:"objectPrefix"`
+		}
+		reloadRequest := &ReloadRequest{}
+		if err := json.NewDecoder(r.Body).Decode(reloadRequest); err != nil {
+			klog.Errorf("failed to decode the request body: %v", err)
+			http.Error(w, fmt.Sprintf("failed to decode the request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		for _, sp := range socketPaths {
+			if filepath.Base(filepath.Dir(sp)) != reloadRequest.VolumeName {
+				continue
+			}
+			errWriter := sidecarmounter.NewErrorWriter(filepath.Join(filepath.Dir(sp), "error"))
+			mountConfig, err := prepareMountConfig(sp, reloadRequest.ObjectPrefix)
+			if err != nil {
+				errMsg := fmt.Sprintf("failed prepare mount config: socket path %q: %v\n", sp, err)
+				klog.Errorf(errMsg)
+				if _, e := errWriter.Write([]byte(errMsg)); e != nil {
+					klog.Errorf("failed to write the error message %q: %v", errMsg, e)
 				}
+				continue
+			}
+			mountConfig.ErrWriter = errWriter
 
-				if err = cmd.Start(); err != nil {
-					errMsg := fmt.Sprintf("failed to start gcsfuse with error: %v\n", err)
-					klog.Errorf(errMsg)
-					if _, e := errWriter.Write([]byte(errMsg)); e != nil {
-						klog.Errorf("failed to write the error message %q: %v", errMsg, e)
-					}
+			go runGcsfuse(mounter, mountConfig, errWriter, mounter.Reload)
+		}
+		return
+	}))
 
-					return
-				}
+	http.DefaultServeMux.Handle("/unmount", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type UnmountRequest struct {
+			VolumeName string `json:"volumeName"`
+		}
+		unmountRequest := &UnmountRequest{}
+		if err := json.NewDecoder(r.Body).Decode(unmountRequest); err != nil {
+			klog.Errorf("failed to decode the request body: %v", err)
+			http.Error(w, fmt.Sprintf("failed to decode the request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := mounter.Unmount(unmountRequest.VolumeName); err != nil {
+			klog.Errorf("failed to unmount volume %q: %v", unmountRequest.VolumeName, err)
+			http.Error(w, fmt.Sprintf("failed to unmount volume %q: %v", unmountRequest.VolumeName, err), http.StatusInternalServerError)
+		}
+	}))
 
-				// Since the gcsfuse has taken over the file descriptor,
-				// closing the file descriptor to avoid other process forking it.
-				syscall.Close(mc.FileDescriptor)
-				if err = cmd.Wait(); err != nil {
-					errMsg := fmt.Sprintf("gcsfuse exited with error: %v\n", err)
-					klog.Errorf(errMsg)
-					if _, e := errWriter.Write([]byte(errMsg)); e != nil {
-						klog.Errorf("failed to write the error message %q: %v", errMsg, e)
-					}
-				} else {
-					klog.Infof("[%v] gcsfuse exited normally.", mc.VolumeName)
-				}
-			}(mountConfig)
+	http.DefaultServeMux.Handle("/cache/prune", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		volumeName := r.URL.Query().Get("volume")
+		if err := mounter.PruneCache(volumeName); err != nil {
+			klog.Errorf("failed to prune cache: %v", err)
+			http.Error(w, fmt.Sprintf("failed to prune cache: %v", err), http.StatusInternalServerError)
 		}
-		return
 	}))
 
 	c := make(chan os.Signal, 1)
@@ -162,7 +208,7 @@ func main() {
 			return
 		}
 	}()
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.Serve(apiListener); err != nil && err != http.ErrServerClosed {
 		klog.Fatalf("failed to start the http server: %v", err)
 	}
 	<-c // blocking the process
@@ -171,6 +217,85 @@ func main() {
 	klog.Info("exiting sidecar mounter...")
 }
 
+// newAPIListener returns the net.Listener the sidecar HTTP API is served
+// on. Passing -enable-tcp-api=false switches from the default, unauthenticated
+// TCP listener on :8080 to a unix domain socket guarded by SO_PEERCRED,
+// only accepting connections from UID 0 or *nodeDriverUID. TCP remains the
+// default, and the unauthenticated :8080 API remains reachable by default,
+// until the CSI node driver (out of tree) is updated to dial the unix
+// socket at -api-socket-path instead of POSTing to :8080; that update is
+// not part of this series.
+func newAPIListener() (net.Listener, error) {
+	if *enableTCPAPI {
+		listener, err := net.Listen("tcp", ":8080")
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on :8080: %w", err)
+		}
+
+		return listener, nil
+	}
+
+	if err := syscall.Unlink(*apiSocketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale api socket %q: %w", *apiSocketPath, err)
+	}
+
+	listener, err := net.Listen("unix", *apiSocketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket %q: %w", *apiSocketPath, err)
+	}
+
+	return &peerCredListener{Listener: listener, allowedUID: uint32(*nodeDriverUID)}, nil
+}
+
+// runGcsfuse starts gcsfuse for mc via start (mounter.Mount or
+// mounter.Reload), then supervises it until it exits, recording any error
+// to errWriter along the way. It calls mounter.MarkStarted and
+// mounter.MarkExited on the Mount start returns, rather than letting
+// /metrics or /volumes read mount.Cmd's fields directly: cmd.Wait() below
+// mutates cmd.ProcessState with no synchronization, so MarkStarted and
+// MarkExited are the only safe way to publish this goroutine's view of the
+// process's lifecycle to the rest of the package.
+func runGcsfuse(mounter *sidecarmounter.Mounter, mc *sidecarmounter.MountConfig, errWriter *sidecarmounter.ErrorWriter, start func(*sidecarmounter.MountConfig) (*sidecarmounter.Mount, error)) {
+	mount, err := start(mc)
+	if err != nil {
+		errMsg := fmt.Sprintf("failed to mount bucket %q for volume %q: %v\n", mc.BucketName, mc.VolumeName, err)
+		klog.Errorf(errMsg)
+		if _, e := errWriter.Write([]byte(errMsg)); e != nil {
+			klog.Errorf("failed to write the error message %q: %v", errMsg, e)
+		}
+
+		return
+	}
+
+	cmd := mount.Cmd
+	if err = cmd.Start(); err != nil {
+		errMsg := fmt.Sprintf("failed to start gcsfuse with error: %v\n", err)
+		klog.Errorf(errMsg)
+		if _, e := errWriter.Write([]byte(errMsg)); e != nil {
+			klog.Errorf("failed to write the error message %q: %v", errMsg, e)
+		}
+
+		return
+	}
+
+	mounter.MarkStarted(mount)
+
+	// Since the gcsfuse has taken over the file descriptor,
+	// closing the file descriptor to avoid other process forking it.
+	syscall.Close(mc.FileDescriptor)
+	err = cmd.Wait()
+	mounter.MarkExited(mount)
+	if err != nil {
+		errMsg := fmt.Sprintf("gcsfuse exited with error: %v\n", err)
+		klog.Errorf(errMsg)
+		if _, e := errWriter.Write([]byte(errMsg)); e != nil {
+			klog.Errorf("failed to write the error message %q: %v", errMsg, e)
+		}
+	} else {
+		klog.Infof("[%v] gcsfuse exited normally.", mc.VolumeName)
+	}
+}
+
 // Fetch the following information from a given socket path:
 // 1. Pod volume name
 // 2. The file descriptor
@@ -203,6 +328,11 @@ func prepareMountConfig(sp string, dir string) (*sidecarmounter.MountConfig, err
 
 	mc.FileDescriptor = fd
 
+	// BucketName, Options, TargetPath, and CacheSizeBytes all come from the
+	// CSI node driver's socket payload here. TargetPath in particular is
+	// only ever populated this way: there is no other code path in the
+	// sidecar that sets it, so Reload's drain-wait only takes effect once
+	// the node driver's payload actually includes it.
 	if err := json.Unmarshal(msg, &mc); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal the mount config: %w", err)
 	}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// peerCredListener wraps a unix domain socket net.Listener and only hands
+// back connections from peers authorized by SO_PEERCRED, so a compromised
+// sidecar sharing the Pod's network namespace cannot trigger mounts or tear
+// down gcsfuse processes belonging to another volume.
+type peerCredListener struct {
+	net.Listener
+	allowedUID uint32
+}
+
+// Accept blocks until it can return a connection from an authorized peer,
+// silently dropping connections from anyone else.
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := peerUID(conn)
+		if err != nil {
+			klog.Errorf("failed to get peer credentials for the sidecar API connection: %v", err)
+			conn.Close()
+
+			continue
+		}
+
+		if uid != 0 && uid != l.allowedUID {
+			klog.Errorf("rejecting sidecar API connection from unauthorized uid %d", uid)
+			conn.Close()
+
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+// peerUID returns the UID of the process on the other end of conn, which
+// must be a unix domain socket connection.
+func peerUID(conn net.Conn) (uint32, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("connection is not a unix socket connection")
+	}
+
+	sock, err := unixConn.File()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the socket file: %w", err)
+	}
+	defer sock.Close()
+
+	ucred, err := unix.GetsockoptUcred(int(sock.Fd()), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get SO_PEERCRED: %w", err)
+	}
+
+	return ucred.Uid, nil
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cache enforces a byte budget on each volume's gcsfuse cache
+// directory, evicting the least recently used files once the budget is
+// exceeded.
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// pollInterval is how often each watched cache directory is checked against
+// its byte budget.
+const pollInterval = 30 * time.Second
+
+// OpenFilesFunc returns the absolute paths currently held open by the
+// gcsfuse process that owns a cache directory, so eviction can skip files
+// that are still in use.
+type OpenFilesFunc func() (map[string]bool, error)
+
+type file struct {
+	path string
+	size int64
+	// lastUsed is the later of the file's access and modification times.
+	lastUsed time.Time
+}
+
+// Watcher enforces a byte budget on a single volume's cache directory.
+type Watcher struct {
+	volumeName  string
+	dir         string
+	budgetBytes int64
+	openFiles   OpenFilesFunc
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// NewWatcher starts a background goroutine that enforces budgetBytes on dir
+// for volumeName, polling every pollInterval. Call Stop to tear it down,
+// typically when the volume is unmounted.
+func NewWatcher(volumeName, dir string, budgetBytes int64, openFiles OpenFilesFunc) *Watcher {
+	w := &Watcher{
+		volumeName:  volumeName,
+		dir:         dir,
+		budgetBytes: budgetBytes,
+		openFiles:   openFiles,
+		stopCh:      make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+func (w *Watcher) run() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Prune(); err != nil {
+				klog.Errorf("[%v] failed to enforce cache budget: %v", w.volumeName, err)
+			}
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// Stop terminates the background enforcement goroutine. It is safe to call
+// more than once.
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stopCh) })
+}
+
+// Prune synchronously evicts the least recently used files in the cache
+// directory until it is at or under the byte budget, skipping any file
+// currently held open by the gcsfuse process. A budget of zero or less
+// disables eviction.
+func (w *Watcher) Prune() error {
+	if w.budgetBytes <= 0 {
+		return nil
+	}
+
+	openFiles := map[string]bool{}
+	if w.openFiles != nil {
+		of, err := w.openFiles()
+		if err != nil {
+			return fmt.Errorf("failed to list open files for volume %q: %w", w.volumeName, err)
+		}
+		openFiles = of
+	}
+
+	files, total, err := listFiles(w.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list cache directory %q: %w", w.dir, err)
+	}
+
+	if total <= w.budgetBytes {
+		return nil
+	}
+
+	// Oldest lastUsed first: least recently used, evicted first.
+	sort.Slice(files, func(i, j int) bool { return files[i].lastUsed.Before(files[j].lastUsed) })
+
+	for _, f := range files {
+		if total <= w.budgetBytes {
+			break
+		}
+		if openFiles[f.path] {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			klog.Errorf("[%v] failed to evict cache file %q: %v", w.volumeName, f.path, err)
+
+			continue
+		}
+		total -= f.size
+		klog.V(4).Infof("[%v] evicted cache file %q (%d bytes)", w.volumeName, f.path, f.size)
+	}
+
+	return nil
+}
+
+func listFiles(dir string) ([]file, int64, error) {
+	var (
+		files []file
+		total int64
+	)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		lastUsed := info.ModTime()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if atime := time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)); atime.After(lastUsed) {
+				lastUsed = atime
+			}
+		}
+		files = append(files, file{path: path, size: info.Size(), lastUsed: lastUsed})
+		total += info.Size()
+
+		return nil
+	})
+	if err != nil && os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+
+	return files, total, err
+}
+
+// Manager owns one Watcher per mounted volume and exposes synchronous
+// pruning for the /cache/prune HTTP handlers.
+type Manager struct {
+	mutex    sync.Mutex
+	watchers map[string]*Watcher
+}
+
+// NewManager returns an empty Manager.
+func NewManager() *Manager {
+	return &Manager{watchers: make(map[string]*Watcher)}
+}
+
+// Watch starts, or restarts, budget enforcement for volumeName's cache
+// directory.
+func (m *Manager) Watch(volumeName, dir string, budgetBytes int64, openFiles OpenFilesFunc) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if existing, ok := m.watchers[volumeName]; ok {
+		existing.Stop()
+	}
+	m.watchers[volumeName] = NewWatcher(volumeName, dir, budgetBytes, openFiles)
+}
+
+// Unwatch stops budget enforcement for volumeName, e.g. after unmount.
+func (m *Manager) Unwatch(volumeName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if w, ok := m.watchers[volumeName]; ok {
+		w.Stop()
+		delete(m.watchers, volumeName)
+	}
+}
+
+// Prune synchronously evicts cache for volumeName, or for every watched
+// volume if volumeName is empty. It returns an error if volumeName is
+// non-empty and no watcher is registered for it.
+func (m *Manager) Prune(volumeName string) error {
+	m.mutex.Lock()
+	var watchers []*Watcher
+	if volumeName == "" {
+		for _, w := range m.watchers {
+			watchers = append(watchers, w)
+		}
+	} else if w, ok := m.watchers[volumeName]; ok {
+		watchers = append(watchers, w)
+	}
+	m.mutex.Unlock()
+
+	if volumeName != "" && len(watchers) == 0 {
+		return fmt.Errorf("no cache watcher found for volume %q", volumeName)
+	}
+
+	var errs []string
+	for _, w := range watchers {
+		if err := w.Prune(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to prune cache: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFileWithModTime(t *testing.T, dir, name string, size int, modTime time.Time) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0o600); err != nil {
+		t.Fatalf("failed to write %q: %v", path, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("failed to set mtime for %q: %v", path, err)
+	}
+
+	return path
+}
+
+func TestPruneEvictsLeastRecentlyUsedFirst(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	oldest := writeFileWithModTime(t, dir, "oldest", 10, now.Add(-3*time.Hour))
+	middle := writeFileWithModTime(t, dir, "middle", 10, now.Add(-2*time.Hour))
+	newest := writeFileWithModTime(t, dir, "newest", 10, now.Add(-1*time.Hour))
+
+	w := &Watcher{volumeName: "vol", dir: dir, budgetBytes: 15}
+
+	if err := w.Prune(); err != nil {
+		t.Fatalf("Prune returned error: %v", err)
+	}
+
+	if _, err := os.Stat(oldest); !os.IsNotExist(err) {
+		t.Errorf("expected the oldest file to be evicted, stat error: %v", err)
+	}
+	if _, err := os.Stat(middle); !os.IsNotExist(err) {
+		t.Errorf("expected the middle file to be evicted, stat error: %v", err)
+	}
+	if _, err := os.Stat(newest); err != nil {
+		t.Errorf("expected the newest file to survive, stat error: %v", err)
+	}
+}
+
+func TestPruneSkipsOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFileWithModTime(t, dir, "open", 10, time.Now().Add(-time.Hour))
+
+	w := &Watcher{
+		volumeName:  "vol",
+		dir:         dir,
+		budgetBytes: 1,
+		openFiles: func() (map[string]bool, error) {
+			return map[string]bool{path: true}, nil
+		},
+	}
+
+	if err := w.Prune(); err != nil {
+		t.Fatalf("Prune returned error: %v", err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the open file to survive eviction, stat error: %v", err)
+	}
+}
+
+func TestPruneDisabledForNonPositiveBudget(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFileWithModTime(t, dir, "f", 100, time.Now())
+
+	w := &Watcher{volumeName: "vol", dir: dir, budgetBytes: 0}
+
+	if err := w.Prune(); err != nil {
+		t.Fatalf("Prune returned error: %v", err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected eviction to be disabled for a zero budget, stat error: %v", err)
+	}
+}
+
+func TestPruneNoopUnderBudget(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFileWithModTime(t, dir, "f", 10, time.Now())
+
+	w := &Watcher{volumeName: "vol", dir: dir, budgetBytes: 1000}
+
+	if err := w.Prune(); err != nil {
+		t.Fatalf("Prune returned error: %v", err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the file to survive when already under budget, stat error: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecarmounter
+
+import "os"
+
+// ErrorWriter appends gcsfuse error output to the per-volume error file so
+// the CSI node driver can surface it back to the caller of NodePublishVolume.
+type ErrorWriter struct {
+	path string
+}
+
+// NewErrorWriter returns an ErrorWriter that appends to the file at path.
+func NewErrorWriter(path string) *ErrorWriter {
+	return &ErrorWriter{path: path}
+}
+
+// Write appends p to the error file, creating it if it does not exist.
+func (ew *ErrorWriter) Write(p []byte) (int, error) {
+	f, err := os.OpenFile(ew.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.Write(p)
+}
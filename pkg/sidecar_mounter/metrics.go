@@ -0,0 +1,243 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecarmounter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// VolumeStatus is the JSON representation of a single mount returned by the
+// /volumes inspection endpoint.
+type VolumeStatus struct {
+	VolumeName string    `json:"volumeName"`
+	BucketName string    `json:"bucketName"`
+	Options    []string  `json:"options"`
+	PID        int       `json:"pid"`
+	StartTime  time.Time `json:"startTime,omitempty"`
+	Running    bool      `json:"running"`
+	Restarts   int       `json:"restarts"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+// MetricsCollector renders the Mounter's current state as Prometheus metrics
+// and as the JSON payload served by the /volumes endpoint.
+type MetricsCollector struct {
+	mounter *Mounter
+}
+
+// NewMetricsCollector returns a MetricsCollector backed by mounter.
+func NewMetricsCollector(mounter *Mounter) *MetricsCollector {
+	return &MetricsCollector{mounter: mounter}
+}
+
+// WriteMetrics renders the current metrics snapshot to w in the Prometheus
+// text exposition format.
+func (c *MetricsCollector) WriteMetrics(w io.Writer) {
+	mounts := c.mounter.GetMounts()
+
+	fmt.Fprintln(w, "# HELP gcsfuse_process_up Whether the gcsfuse process for a volume is running (1) or not (0).")
+	fmt.Fprintln(w, "# TYPE gcsfuse_process_up gauge")
+	for volumeName, mount := range mounts {
+		up := 0
+		if processRunning(mount) {
+			up = 1
+		}
+		fmt.Fprintf(w, "gcsfuse_process_up{volume=%q,bucket=%q} %d\n", volumeName, mount.Config.BucketName, up)
+	}
+
+	fmt.Fprintln(w, "# HELP gcsfuse_restarts_total Number of times gcsfuse has been restarted for a volume.")
+	fmt.Fprintln(w, "# TYPE gcsfuse_restarts_total counter")
+	for volumeName, mount := range mounts {
+		fmt.Fprintf(w, "gcsfuse_restarts_total{volume=%q} %d\n", volumeName, mount.Restarts)
+	}
+
+	fmt.Fprintln(w, "# HELP gcsfuse_mount_errors_total Number of lines recorded in the per-volume error file.")
+	fmt.Fprintln(w, "# TYPE gcsfuse_mount_errors_total counter")
+	for volumeName, mount := range mounts {
+		fmt.Fprintf(w, "gcsfuse_mount_errors_total{volume=%q} %d\n", volumeName, countErrorLines(mount.Config))
+	}
+
+	fmt.Fprintln(w, "# HELP gcsfuse_uptime_seconds How long the gcsfuse process for a volume has been running.")
+	fmt.Fprintln(w, "# TYPE gcsfuse_uptime_seconds gauge")
+	for volumeName, mount := range mounts {
+		var uptime float64
+		if !mount.StartTime.IsZero() && processRunning(mount) {
+			uptime = time.Since(mount.StartTime).Seconds()
+		}
+		fmt.Fprintf(w, "gcsfuse_uptime_seconds{volume=%q} %.0f\n", volumeName, uptime)
+	}
+
+	fmt.Fprintln(w, "# HELP gcsfuse_cache_dir_bytes Size of the gcsfuse cache directory for a volume.")
+	fmt.Fprintln(w, "# TYPE gcsfuse_cache_dir_bytes gauge")
+	for volumeName, mount := range mounts {
+		size, err := dirSize(mount.Config.CacheDir)
+		if err != nil {
+			klog.Errorf("failed to compute cache dir size for volume %q: %v", volumeName, err)
+
+			continue
+		}
+		fmt.Fprintf(w, "gcsfuse_cache_dir_bytes{volume=%q} %d\n", volumeName, size)
+	}
+
+	fmt.Fprintln(w, "# HELP gcsfuse_open_fds Number of open file descriptors held by the gcsfuse process for a volume.")
+	fmt.Fprintln(w, "# TYPE gcsfuse_open_fds gauge")
+	for volumeName, mount := range mounts {
+		count, err := openFDCount(mount)
+		if err != nil {
+			klog.Errorf("failed to count open file descriptors for volume %q: %v", volumeName, err)
+
+			continue
+		}
+		fmt.Fprintf(w, "gcsfuse_open_fds{volume=%q} %d\n", volumeName, count)
+	}
+}
+
+// VolumeStatuses returns the current state of every tracked volume for the
+// /volumes inspection endpoint.
+func (c *MetricsCollector) VolumeStatuses() []VolumeStatus {
+	mounts := c.mounter.GetMounts()
+	statuses := make([]VolumeStatus, 0, len(mounts))
+
+	for volumeName, mount := range mounts {
+		status := VolumeStatus{
+			VolumeName: volumeName,
+			BucketName: mount.Config.BucketName,
+			Options:    mount.Config.Options,
+			PID:        mount.PID,
+			StartTime:  mount.StartTime,
+			Running:    processRunning(mount),
+			Restarts:   mount.Restarts,
+			LastError:  lastErrorLine(mount.Config),
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// processRunning reports whether mount's gcsfuse process is tracked as
+// running. It reads the Running field GetMounts() copied under the
+// Mounter's mutex rather than mount.Cmd.ProcessState, which is written by
+// the goroutine blocked in cmd.Wait() without synchronization and would
+// otherwise race with every /metrics and /volumes scrape.
+func processRunning(mount *Mount) bool {
+	return mount.Running
+}
+
+func countErrorLines(mc *MountConfig) int {
+	if mc == nil || mc.ErrWriter == nil {
+		return 0
+	}
+
+	b, err := os.ReadFile(mc.ErrWriter.path)
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, line := range splitLines(b) {
+		if line != "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+func lastErrorLine(mc *MountConfig) string {
+	if mc == nil || mc.ErrWriter == nil {
+		return ""
+	}
+
+	b, err := os.ReadFile(mc.ErrWriter.path)
+	if err != nil {
+		return ""
+	}
+
+	lines := splitLines(b)
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i] != "" {
+			return lines[i]
+		}
+	}
+
+	return ""
+}
+
+func splitLines(b []byte) []string {
+	lines := []string{}
+	start := 0
+	for i, c := range b {
+		if c == '\n' {
+			lines = append(lines, string(b[start:i]))
+			start = i + 1
+		}
+	}
+	if start < len(b) {
+		lines = append(lines, string(b[start:]))
+	}
+
+	return lines
+}
+
+// dirSize walks dir and sums the size of every regular file in it.
+func dirSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// openFDCount returns the number of open file descriptors held by mount's
+// process, read from /proc/<pid>/fd.
+func openFDCount(mount *Mount) (int, error) {
+	if !processRunning(mount) {
+		return 0, nil
+	}
+
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", mount.PID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	return len(entries), nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecarmounter
+
+import (
+	"os/exec"
+	"testing"
+)
+
+// TestMarkStartedAndMarkExitedTrackRunningState exercises the bookkeeping
+// that replaced reading cmd.Process/cmd.ProcessState directly from
+// /metrics and /volumes: MarkStarted and MarkExited must be the only
+// things that flip Mount.Running and set Mount.PID, and GetMounts' copy
+// under the mutex must observe that state correctly.
+func TestMarkStartedAndMarkExitedTrackRunningState(t *testing.T) {
+	gcsfusePath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skipf("sleep not available: %v", err)
+	}
+
+	m := New(gcsfusePath, 0)
+	mount, err := m.Mount(&MountConfig{VolumeName: "vol", BucketName: "1"})
+	if err != nil {
+		t.Fatalf("Mount failed: %v", err)
+	}
+
+	if processRunning(mount) {
+		t.Fatal("expected a freshly prepared Mount to not be running yet")
+	}
+
+	if err := mount.Cmd.Start(); err != nil {
+		t.Fatalf("failed to start sleep: %v", err)
+	}
+	m.MarkStarted(mount)
+
+	snapshot := m.GetMounts()["vol"]
+	if !processRunning(snapshot) {
+		t.Error("expected the GetMounts snapshot to report running after MarkStarted")
+	}
+	if snapshot.PID == 0 {
+		t.Error("expected MarkStarted to record a non-zero PID")
+	}
+
+	if err := mount.Cmd.Wait(); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	m.MarkExited(mount)
+
+	snapshot = m.GetMounts()["vol"]
+	if processRunning(snapshot) {
+		t.Error("expected the GetMounts snapshot to report not running after MarkExited")
+	}
+}
@@ -0,0 +1,424 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sidecarmounter spawns and supervises gcsfuse processes on behalf
+// of the CSI node driver, one per volume mounted into the workload Pod.
+package sidecarmounter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcs-fuse-csi-driver/pkg/sidecar_mounter/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// drainPollInterval is how often Reload checks whether the workload has
+	// stopped holding file descriptors into the mount it is about to replace.
+	drainPollInterval = time.Second
+	// drainTimeout bounds how long Reload waits for the workload to drain
+	// before giving up and failing the reload.
+	drainTimeout = 30 * time.Second
+	// terminatePollInterval is how often terminate checks whether a signaled
+	// process has exited.
+	terminatePollInterval = 200 * time.Millisecond
+)
+
+// MountConfig carries everything the sidecar needs to invoke gcsfuse for a
+// single volume. It is populated partly from the socket handshake with the
+// CSI node driver (BucketName, Options, FileDescriptor) and partly by the
+// sidecar itself (VolumeName, CacheDir, ConfigFile, ErrWriter).
+type MountConfig struct {
+	FileDescriptor int      `json:"-"`
+	BucketName     string   `json:"bucketName,omitempty"`
+	Options        []string `json:"options,omitempty"`
+	VolumeName     string   `json:"-"`
+	CacheDir       string   `json:"-"`
+	ConfigFile     string   `json:"-"`
+	// TargetPath is the path the CSI node driver bind-mounts the gcsfuse
+	// mount point to inside the workload container. Reload uses it to
+	// detect when the workload has stopped holding file descriptors into
+	// the mount being replaced. Like BucketName and Options, it is
+	// populated by the generic json.Unmarshal of the CSI node driver's
+	// socket payload in prepareMountConfig; it is only ever set if the
+	// driver's payload includes it.
+	TargetPath string `json:"targetPath,omitempty"`
+	// CacheSizeBytes bounds how large CacheDir is allowed to grow before
+	// the least recently used cached objects are evicted. Zero or
+	// negative disables eviction.
+	CacheSizeBytes int64        `json:"cacheSizeBytes,omitempty"`
+	ErrWriter      *ErrorWriter `json:"-"`
+}
+
+// Mount tracks a single gcsfuse invocation alongside the metadata the
+// metrics and inspection endpoints report on. Running and PID are written
+// by MarkStarted and MarkExited under the Mounter's mutex, and must be read
+// the same way: cmd.Process and cmd.ProcessState are themselves mutated by
+// the goroutine blocked in cmd.Wait() without synchronization, so nothing
+// outside that goroutine may read them directly.
+type Mount struct {
+	Cmd       *exec.Cmd
+	Config    *MountConfig
+	StartTime time.Time
+	Restarts  int
+	Running   bool
+	PID       int
+}
+
+// Mounter spawns gcsfuse processes and keeps track of the running ones so
+// they can be looked up, replaced, or torn down by volume name.
+type Mounter struct {
+	mutex       sync.Mutex
+	gcsfusePath string
+	gracePeriod time.Duration
+	mounts      map[string]*Mount
+	cache       *cache.Manager
+}
+
+// New returns a Mounter that invokes the gcsfuse binary at gcsfusePath.
+// gracePeriod bounds how long Reload and Unmount wait after SIGTERM before
+// they escalate to SIGKILL.
+func New(gcsfusePath string, gracePeriod time.Duration) *Mounter {
+	return &Mounter{
+		gcsfusePath: gcsfusePath,
+		gracePeriod: gracePeriod,
+		mounts:      make(map[string]*Mount),
+		cache:       cache.NewManager(),
+	}
+}
+
+// GetCmds returns the currently tracked gcsfuse processes, keyed by volume
+// name.
+func (m *Mounter) GetCmds() map[string]*exec.Cmd {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cmds := make(map[string]*exec.Cmd, len(m.mounts))
+	for k, v := range m.mounts {
+		cmds[k] = v.Cmd
+	}
+
+	return cmds
+}
+
+// GetMounts returns a snapshot of the currently tracked mounts, keyed by
+// volume name. Because the copy is taken under the mutex that MarkStarted
+// and MarkExited also use to write Running and PID, the snapshot's view of
+// those two fields is race-free even though Cmd itself is shared with a
+// goroutine that may still be inside cmd.Wait().
+func (m *Mounter) GetMounts() map[string]*Mount {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mounts := make(map[string]*Mount, len(m.mounts))
+	for k, v := range m.mounts {
+		mv := *v
+		mounts[k] = &mv
+	}
+
+	return mounts
+}
+
+// Mount prepares an *exec.Cmd that will start gcsfuse for the given
+// MountConfig and begins tracking it. If a gcsfuse process is already
+// tracked for mc.VolumeName -- e.g. a duplicate /mount call for a volume
+// that was never unmounted -- it is terminated once the replacement is
+// tracked, so it cannot keep running untracked, still holding its file
+// descriptor and writing into the same cache directory, while bookkeeping
+// silently moves on to the new process. The caller is responsible for
+// calling cmd.Start(), then MarkStarted, then cmd.Wait(), then MarkExited,
+// on the returned Mount.
+func (m *Mounter) Mount(mc *MountConfig) (*Mount, error) {
+	if mc.BucketName == "" {
+		return nil, fmt.Errorf("failed to mount volume %q: bucket name is empty", mc.VolumeName)
+	}
+
+	args := append([]string{}, mc.Options...)
+	args = append(args, mc.BucketName)
+
+	klog.V(4).Infof("[%v] mounting bucket %q with arguments %v", mc.VolumeName, mc.BucketName, args)
+
+	//nolint:gosec
+	cmd := exec.Command(m.gcsfusePath, args...)
+	cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(mc.FileDescriptor), mc.VolumeName)}
+
+	m.mutex.Lock()
+	existing, hadExisting := m.mounts[mc.VolumeName]
+	restarts := 0
+	if hadExisting {
+		restarts = existing.Restarts + 1
+	}
+	mount := &Mount{Cmd: cmd, Config: mc, Restarts: restarts}
+	m.mounts[mc.VolumeName] = mount
+	m.mutex.Unlock()
+
+	if hadExisting {
+		klog.Infof("[%v] a gcsfuse process was already tracked for this volume; terminating it before starting the replacement", mc.VolumeName)
+		if err := terminate(existing.Cmd, m.gracePeriod, func() bool { return m.isRunning(existing) }); err != nil {
+			klog.Errorf("[%v] failed to terminate previous gcsfuse process: %v", mc.VolumeName, err)
+		}
+	}
+
+	if mc.CacheDir != "" {
+		m.cache.Watch(mc.VolumeName, mc.CacheDir, mc.CacheSizeBytes, func() (map[string]bool, error) {
+			return m.openFiles(mount)
+		})
+	}
+
+	return mount, nil
+}
+
+// PruneCache synchronously evicts cache for volumeName, or for every
+// mounted volume if volumeName is empty.
+func (m *Mounter) PruneCache(volumeName string) error {
+	return m.cache.Prune(volumeName)
+}
+
+// MarkStarted records that mount's gcsfuse process has successfully
+// started: its start time, for the uptime metric, its PID, and that it is
+// running. /metrics, /volumes, and terminate's poll loop all read this
+// state instead of mount.Cmd's fields directly.
+func (m *Mounter) MarkStarted(mount *Mount) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mount.StartTime = time.Now()
+	mount.Running = true
+	if mount.Cmd.Process != nil {
+		mount.PID = mount.Cmd.Process.Pid
+	}
+}
+
+// MarkExited records that mount's gcsfuse process has exited. It must be
+// called exactly once, by the same goroutine that called cmd.Wait() on
+// mount.Cmd, immediately after Wait returns.
+func (m *Mounter) MarkExited(mount *Mount) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mount.Running = false
+}
+
+// isRunning reports whether mount's gcsfuse process is currently tracked as
+// running, reading the state MarkStarted/MarkExited maintain rather than
+// mount.Cmd's fields.
+func (m *Mounter) isRunning(mount *Mount) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return mount.Running
+}
+
+// openFiles returns the absolute paths mount's gcsfuse process currently
+// holds open, read from /proc/<pid>/fd. It is used to skip cache files that
+// are still in use when enforcing a volume's cache budget. PID and running
+// state are snapshotted under the Mounter's mutex before the /proc scan,
+// rather than read from mount.Cmd directly.
+func (m *Mounter) openFiles(mount *Mount) (map[string]bool, error) {
+	m.mutex.Lock()
+	running := mount.Running
+	pid := mount.PID
+	m.mutex.Unlock()
+
+	if !running {
+		return map[string]bool{}, nil
+	}
+
+	return openFilePathsForPID(pid)
+}
+
+// Reload replaces the gcsfuse process for an already-mounted volume with a
+// fresh one started from mc, which carries a new file descriptor received
+// over the socket. It waits for the workload to drain its open file
+// descriptors into the existing mount before tearing it down, so in-flight
+// I/O is not dropped the way a bare process kill would drop it. If no
+// gcsfuse process is currently running for the volume, Reload behaves like
+// a first-time Mount. As with Mount, the caller is responsible for calling
+// cmd.Start(), MarkStarted, cmd.Wait(), and MarkExited on the returned
+// Mount.
+func (m *Mounter) Reload(mc *MountConfig) (*Mount, error) {
+	existing, ok := m.GetMounts()[mc.VolumeName]
+	if !ok || !existing.Running {
+		return m.Mount(mc)
+	}
+
+	if err := waitForDrain(existing, drainPollInterval, drainTimeout); err != nil {
+		return nil, fmt.Errorf("failed to drain volume %q before reload: %w", mc.VolumeName, err)
+	}
+
+	if err := terminate(existing.Cmd, m.gracePeriod, func() bool { return m.isRunning(existing) }); err != nil {
+		return nil, fmt.Errorf("failed to terminate previous gcsfuse process for volume %q: %w", mc.VolumeName, err)
+	}
+
+	return m.Mount(mc)
+}
+
+// Unmount sends SIGTERM to the gcsfuse process for volumeName, escalating to
+// SIGKILL after the Mounter's grace period if it has not exited, then
+// cleans up the volume's tracked state and error file.
+func (m *Mounter) Unmount(volumeName string) error {
+	m.mutex.Lock()
+	mount, ok := m.mounts[volumeName]
+	m.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no gcsfuse process found for volume %q", volumeName)
+	}
+
+	m.cache.Unwatch(volumeName)
+
+	if err := terminate(mount.Cmd, m.gracePeriod, func() bool { return m.isRunning(mount) }); err != nil {
+		return fmt.Errorf("failed to terminate gcsfuse process for volume %q: %w", volumeName, err)
+	}
+
+	m.mutex.Lock()
+	delete(m.mounts, volumeName)
+	m.mutex.Unlock()
+
+	if mount.Config.ErrWriter != nil {
+		if err := os.Remove(mount.Config.ErrWriter.path); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("failed to remove error file for volume %q: %v", volumeName, err)
+		}
+	}
+
+	return nil
+}
+
+// terminate sends SIGTERM to cmd's process and waits up to gracePeriod for
+// running to report that it has exited, escalating to SIGKILL if it is
+// still running afterwards. running must report the Mount's tracked state
+// (see Mounter.isRunning) rather than read cmd.ProcessState directly, since
+// that field is written by the goroutine blocked in cmd.Wait() without
+// synchronization.
+func terminate(cmd *exec.Cmd, gracePeriod time.Duration, running func() bool) error {
+	if cmd == nil || cmd.Process == nil || !running() {
+		return nil
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to send SIGTERM: %w", err)
+	}
+
+	deadline := time.Now().Add(gracePeriod)
+	for running() && time.Now().Before(deadline) {
+		time.Sleep(terminatePollInterval)
+	}
+
+	if running() {
+		if err := cmd.Process.Signal(syscall.SIGKILL); err != nil {
+			return fmt.Errorf("failed to send SIGKILL: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// waitForDrain blocks until no process on the node holds an open file
+// descriptor into mount's TargetPath, polling every pollInterval up to
+// timeout. If TargetPath is unset, there is nothing to drain and it returns
+// immediately.
+func waitForDrain(mount *Mount, pollInterval, timeout time.Duration) error {
+	if mount.Config.TargetPath == "" {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		inUse, err := targetPathInUse(mount.Config.TargetPath)
+		if err != nil {
+			return err
+		}
+		if !inUse {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for volume %q to stop being referenced", timeout, mount.Config.VolumeName)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// targetPathInUse reports whether any process on the node holds an open
+// file descriptor referencing targetPath, by inspecting /proc/<pid>/fd.
+// Processes that have exited or that we lack permission to inspect are
+// skipped rather than treated as an error.
+func targetPathInUse(targetPath string) (bool, error) {
+	procEntries, err := os.ReadDir("/proc")
+	if err != nil {
+		return false, fmt.Errorf("failed to list /proc: %w", err)
+	}
+
+	for _, procEntry := range procEntries {
+		pid, err := strconv.Atoi(procEntry.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+		fdEntries, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fdEntry := range fdEntries {
+			link, err := os.Readlink(filepath.Join(fdDir, fdEntry.Name()))
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(link, targetPath) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// openFilePathsForPID returns the absolute paths pid currently holds open,
+// read from /proc/<pid>/fd.
+func openFilePathsForPID(pid int) (map[string]bool, error) {
+	open := map[string]bool{}
+
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fdEntries, err := os.ReadDir(fdDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return open, nil
+		}
+
+		return nil, err
+	}
+
+	for _, fdEntry := range fdEntries {
+		link, err := os.Readlink(filepath.Join(fdDir, fdEntry.Name()))
+		if err != nil {
+			continue
+		}
+		open[link] = true
+	}
+
+	return open, nil
+}
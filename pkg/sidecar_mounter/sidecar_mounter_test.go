@@ -0,0 +1,143 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sidecarmounter
+
+import (
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTerminateSendsSIGTERMAndWaits verifies that terminate signals a real
+// process and returns once the caller's running callback reports it as
+// exited, without needing to escalate to SIGKILL.
+func TestTerminateSendsSIGTERMAndWaits(t *testing.T) {
+	cmd := exec.Command("sleep", "5")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("sleep not available: %v", err)
+	}
+
+	var mu sync.Mutex
+	running := true
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		mu.Lock()
+		running = false
+		mu.Unlock()
+		close(done)
+	}()
+
+	isRunning := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return running
+	}
+
+	if err := terminate(cmd, 2*time.Second, isRunning); err != nil {
+		t.Fatalf("terminate returned error: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("process was still running after terminate returned")
+	}
+}
+
+// TestTerminateNoop covers the guards that let terminate be called
+// unconditionally from Mount, Reload, and Unmount without the caller first
+// checking whether there is anything to tear down.
+func TestTerminateNoop(t *testing.T) {
+	if err := terminate(nil, time.Second, func() bool { return true }); err != nil {
+		t.Errorf("terminate(nil, ...) = %v, want nil", err)
+	}
+
+	cmd := exec.Command("true")
+	if err := terminate(cmd, time.Second, func() bool { return false }); err != nil {
+		t.Errorf("terminate on an unstarted cmd = %v, want nil", err)
+	}
+}
+
+func TestWaitForDrainReturnsImmediatelyWithoutTargetPath(t *testing.T) {
+	mount := &Mount{Config: &MountConfig{VolumeName: "vol"}}
+
+	start := time.Now()
+	if err := waitForDrain(mount, time.Millisecond, time.Hour); err != nil {
+		t.Fatalf("waitForDrain returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("waitForDrain took %v, want an immediate return when TargetPath is unset", elapsed)
+	}
+}
+
+func TestWaitForDrainReturnsWhenTargetPathNotInUse(t *testing.T) {
+	mount := &Mount{Config: &MountConfig{
+		VolumeName: "vol",
+		TargetPath: "/this/path/should/not/be/open/by/any/process/in/this/test",
+	}}
+
+	if err := waitForDrain(mount, 10*time.Millisecond, time.Second); err != nil {
+		t.Fatalf("waitForDrain returned error: %v", err)
+	}
+}
+
+// TestMountTerminatesExistingProcessOnDuplicateMount verifies the orphan fix:
+// calling Mount twice for the same volume name must terminate the
+// previously tracked gcsfuse process rather than leaving it running
+// untracked.
+func TestMountTerminatesExistingProcessOnDuplicateMount(t *testing.T) {
+	gcsfusePath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skipf("sleep not available: %v", err)
+	}
+
+	m := New(gcsfusePath, 2*time.Second)
+	// gcsfuse is invoked as "<gcsfusePath> <options...> <bucketName>"; using
+	// a numeric BucketName and no Options turns that into "sleep 5", a
+	// real long-lived process to terminate.
+	mc := &MountConfig{VolumeName: "vol", BucketName: "5"}
+
+	first, err := m.Mount(mc)
+	if err != nil {
+		t.Fatalf("first Mount failed: %v", err)
+	}
+	if err := first.Cmd.Start(); err != nil {
+		t.Fatalf("failed to start first gcsfuse process: %v", err)
+	}
+	m.MarkStarted(first)
+
+	exited := make(chan struct{})
+	go func() {
+		first.Cmd.Wait()
+		m.MarkExited(first)
+		close(exited)
+	}()
+
+	if _, err := m.Mount(mc); err != nil {
+		t.Fatalf("second Mount failed: %v", err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the first gcsfuse process to be terminated when a duplicate volume was mounted")
+	}
+}
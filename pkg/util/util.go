@@ -0,0 +1,89 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SendMsg sends a file descriptor and an accompanying message over a unix
+// domain socket connection using SCM_RIGHTS ancillary data.
+func SendMsg(conn net.Conn, fd int, msg []byte) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("connection is not a unix socket connection")
+	}
+
+	sock, err := unixConn.File()
+	if err != nil {
+		return fmt.Errorf("failed to get the socket file: %w", err)
+	}
+	defer sock.Close()
+
+	rights := unix.UnixRights(fd)
+	if err := unix.Sendmsg(int(sock.Fd()), msg, rights, nil, 0); err != nil {
+		return fmt.Errorf("failed to send message over the socket: %w", err)
+	}
+
+	return nil
+}
+
+// RecvMsg receives a file descriptor and an accompanying message from a unix
+// domain socket connection sent via SCM_RIGHTS ancillary data.
+func RecvMsg(conn net.Conn) (int, []byte, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, nil, fmt.Errorf("connection is not a unix socket connection")
+	}
+
+	sock, err := unixConn.File()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get the socket file: %w", err)
+	}
+	defer sock.Close()
+
+	msg := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(int(sock.Fd()), msg, oob, 0)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to receive message from the socket: %w", err)
+	}
+
+	scms, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to parse socket control message: %w", err)
+	}
+
+	if len(scms) == 0 {
+		return 0, nil, fmt.Errorf("no file descriptor received from the socket")
+	}
+
+	fds, err := unix.ParseUnixRights(&scms[0])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to parse unix rights: %w", err)
+	}
+
+	if len(fds) == 0 {
+		return 0, nil, fmt.Errorf("no file descriptor received from the socket")
+	}
+
+	return fds[0], msg[:n], nil
+}
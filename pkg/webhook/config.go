@@ -0,0 +1,55 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import "k8s.io/apimachinery/pkg/api/resource"
+
+// Config holds the settings the mutating webhook uses to build the sidecar
+// container it injects into workload Pods.
+type Config struct {
+	ContainerImage                string
+	ImagePullPolicy               string
+	CPURequest                    resource.Quantity
+	CPULimit                      resource.Quantity
+	MemoryRequest                 resource.Quantity
+	MemoryLimit                   resource.Quantity
+	EphemeralStorageRequest       resource.Quantity
+	EphemeralStorageLimit         resource.Quantity
+	TerminationGracePeriodSeconds int64
+
+	// SeccompProfile selects the seccomp profile applied to the sidecar
+	// container's SecurityContext. Leave empty (or set to
+	// "RuntimeDefault") to use the container runtime's default profile;
+	// set to "Localhost" to use the bundled gcsfuse profile at
+	// deploy/seccomp/gcsfuse.json. Setting this to "Localhost" also makes
+	// GetSidecarContainerAnnotations return the matching AppArmor profile
+	// annotation (deploy/apparmor/gcsfuse) for the sidecar container: the
+	// two profiles are authored as a pair and are only ever meaningful
+	// together, so a single knob enables both.
+	SeccompProfile string
+
+	// RequireSidecarSecurityProfiles, when true, makes
+	// ValidatePodHasSidecarContainerInjected also verify that the seccomp
+	// and AppArmor annotations/fields this package injects are present,
+	// rejecting Pods that have stripped them. It only makes sense set
+	// alongside SeccompProfile: "Localhost", since that is what causes
+	// those fields/annotations to be injected in the first place;
+	// enabling it without also setting SeccompProfile: "Localhost" means
+	// validation will always fail.
+	RequireSidecarSecurityProfiles bool
+}
@@ -37,21 +37,50 @@ const (
 	// See the nonroot user discussion: https://github.com/GoogleContainerTools/distroless/issues/443
 	NobodyUID = 65534
 	NobodyGID = 65534
+
+	// SeccompProfileLocalhost is the Config.SeccompProfile value that
+	// selects the bundled gcsfuse seccomp profile instead of the
+	// container runtime's default one.
+	SeccompProfileLocalhost = "Localhost"
+	// seccompProfileLocalhostRef is the profile path relative to the
+	// kubelet's configured seccomp profile root (e.g.
+	// /var/lib/kubelet/seccomp), where deploy/seccomp/gcsfuse.json is
+	// expected to be installed on every node.
+	seccompProfileLocalhostRef = "profiles/gcsfuse.json"
+
+	// AppArmorAnnotationKeyPrefix is the Pod annotation key prefix that
+	// selects an AppArmor profile for a named container.
+	AppArmorAnnotationKeyPrefix = "container.apparmor.security.beta.kubernetes.io/"
+	// appArmorProfileRef confines the sidecar's file writes to the
+	// emptyDir mount paths it is given; see deploy/apparmor/gcsfuse.
+	appArmorProfileRef = "localhost/gke-gcsfuse-sidecar"
 )
 
 func GetSidecarContainerSpec(c *Config) v1.Container {
-	resourceList := v1.ResourceList{}
+	limits := v1.ResourceList{}
+	requests := v1.ResourceList{}
 
 	if c.CPULimit != resource.MustParse("0") {
-		resourceList[v1.ResourceCPU] = c.CPULimit
+		limits[v1.ResourceCPU] = c.CPULimit
+		requests[v1.ResourceCPU] = c.CPULimit
 	}
 
 	if c.MemoryLimit != resource.MustParse("0") {
-		resourceList[v1.ResourceMemory] = c.MemoryLimit
+		limits[v1.ResourceMemory] = c.MemoryLimit
+		requests[v1.ResourceMemory] = c.MemoryLimit
 	}
 
 	if c.EphemeralStorageLimit != resource.MustParse("0") {
-		resourceList[v1.ResourceEphemeralStorage] = c.EphemeralStorageLimit
+		limits[v1.ResourceEphemeralStorage] = c.EphemeralStorageLimit
+	}
+
+	// EphemeralStorageRequest is tracked separately from the limit so the
+	// kubelet reserves space for the cache budget (MountConfig.CacheSizeBytes)
+	// without forcing every Pod to request the full limit.
+	if c.EphemeralStorageRequest != resource.MustParse("0") {
+		requests[v1.ResourceEphemeralStorage] = c.EphemeralStorageRequest
+	} else if c.EphemeralStorageLimit != resource.MustParse("0") {
+		requests[v1.ResourceEphemeralStorage] = c.EphemeralStorageLimit
 	}
 
 	// The sidecar container follows Restricted Pod Security Standard,
@@ -68,7 +97,7 @@ func GetSidecarContainerSpec(c *Config) v1.Container {
 					v1.Capability("ALL"),
 				},
 			},
-			SeccompProfile: &v1.SeccompProfile{Type: v1.SeccompProfileTypeRuntimeDefault},
+			SeccompProfile: seccompProfile(c),
 			RunAsNonRoot:   ptr.To(true),
 			RunAsUser:      ptr.To(int64(NobodyUID)),
 			RunAsGroup:     ptr.To(int64(NobodyGID)),
@@ -78,8 +107,8 @@ func GetSidecarContainerSpec(c *Config) v1.Container {
 			fmt.Sprintf("--grace-period=%v", c.TerminationGracePeriodSeconds),
 		},
 		Resources: v1.ResourceRequirements{
-			Limits:   resourceList,
-			Requests: resourceList,
+			Limits:   limits,
+			Requests: requests,
 		},
 		VolumeMounts: []v1.VolumeMount{
 			{
@@ -96,6 +125,39 @@ func GetSidecarContainerSpec(c *Config) v1.Container {
 	return container
 }
 
+// seccompProfile returns the SecurityContext seccomp profile to apply to
+// the sidecar container. It defaults to the container runtime's profile,
+// matching the Restricted Pod Security Standard; set c.SeccompProfile to
+// SeccompProfileLocalhost to instead use the bundled gcsfuse profile, which
+// only allows the syscalls gcsfuse needs for FUSE, file, and network I/O.
+func seccompProfile(c *Config) *v1.SeccompProfile {
+	if c.SeccompProfile == SeccompProfileLocalhost {
+		return &v1.SeccompProfile{
+			Type:             v1.SeccompProfileTypeLocalhost,
+			LocalhostProfile: ptr.To(seccompProfileLocalhostRef),
+		}
+	}
+
+	return &v1.SeccompProfile{Type: v1.SeccompProfileTypeRuntimeDefault}
+}
+
+// GetSidecarContainerAnnotations returns the Pod annotations that should be
+// applied alongside the sidecar container, if any. Currently this is the
+// AppArmor profile annotation, added whenever seccompProfile selects the
+// bundled Localhost profile: the two profiles are authored as a matched
+// pair (the AppArmor profile's unix/network rules line up with the
+// syscalls the seccomp profile allows) and are gated off the same
+// c.SeccompProfile knob so they can't drift out of sync with each other.
+func GetSidecarContainerAnnotations(c *Config) map[string]string {
+	if c.SeccompProfile != SeccompProfileLocalhost {
+		return nil
+	}
+
+	return map[string]string{
+		AppArmorAnnotationKeyPrefix + SidecarContainerName: appArmorProfileRef,
+	}
+}
+
 func GetSidecarContainerVolumeSpec() []v1.Volume {
 	return []v1.Volume{
 		{
@@ -119,9 +181,14 @@ func GetSidecarContainerVolumeSpec() []v1.Volume {
 // 3. The container uses the temp volume.
 // 4. The temp volume have correct volume mount paths.
 // 5. The Pod has the temp volume. The temp volume has to be an emptyDir.
-func ValidatePodHasSidecarContainerInjected(image string, pod *v1.Pod) bool {
+// 6. If c.RequireSidecarSecurityProfiles is set, the Pod carries the
+// AppArmor annotation this package injects for the sidecar container, and
+// the sidecar container's SecurityContext carries the Localhost seccomp
+// profile this package injects.
+func ValidatePodHasSidecarContainerInjected(image string, pod *v1.Pod, c *Config) bool {
 	containerInjected := false
 	tempVolumeInjected := false
+	var sidecarSeccompProfile *v1.SeccompProfile
 
 	expectedImageRepo, _, _, err := parsers.ParseImageName(image)
 	if err != nil {
@@ -130,9 +197,9 @@ func ValidatePodHasSidecarContainerInjected(image string, pod *v1.Pod) bool {
 		return false
 	}
 
-	for _, c := range pod.Spec.Containers {
-		if c.Name == SidecarContainerName {
-			inputImageRepo, _, _, err := parsers.ParseImageName(c.Image)
+	for _, container := range pod.Spec.Containers {
+		if container.Name == SidecarContainerName {
+			inputImageRepo, _, _, err := parsers.ParseImageName(container.Image)
 			if err != nil {
 				klog.Errorf("Could not parse input image : name %q, error: %v", image, err)
 
@@ -140,13 +207,17 @@ func ValidatePodHasSidecarContainerInjected(image string, pod *v1.Pod) bool {
 			}
 
 			if inputImageRepo == expectedImageRepo &&
-				c.SecurityContext != nil &&
-				*c.SecurityContext.RunAsUser == NobodyUID &&
-				*c.SecurityContext.RunAsGroup == NobodyGID {
+				container.SecurityContext != nil &&
+				*container.SecurityContext.RunAsUser == NobodyUID &&
+				*container.SecurityContext.RunAsGroup == NobodyGID {
 				containerInjected = true
 			}
 
-			for _, v := range c.VolumeMounts {
+			if container.SecurityContext != nil {
+				sidecarSeccompProfile = container.SecurityContext.SeccompProfile
+			}
+
+			for _, v := range container.VolumeMounts {
 				if v.Name == SidecarContainerTmpVolumeName && v.MountPath == SidecarContainerTmpVolumeMountPath {
 					tempVolumeInjected = true
 				}
@@ -168,5 +239,26 @@ func ValidatePodHasSidecarContainerInjected(image string, pod *v1.Pod) bool {
 		}
 	}
 
-	return containerInjected && tempVolumeInjected
+	if !tempVolumeInjected {
+		return false
+	}
+
+	if c.RequireSidecarSecurityProfiles {
+		if pod.Annotations[AppArmorAnnotationKeyPrefix+SidecarContainerName] != appArmorProfileRef {
+			klog.Errorf("Pod %q is missing the required AppArmor annotation for the sidecar container", pod.Name)
+
+			return false
+		}
+
+		if sidecarSeccompProfile == nil ||
+			sidecarSeccompProfile.Type != v1.SeccompProfileTypeLocalhost ||
+			sidecarSeccompProfile.LocalhostProfile == nil ||
+			*sidecarSeccompProfile.LocalhostProfile != seccompProfileLocalhostRef {
+			klog.Errorf("Pod %q is missing the required seccomp profile for the sidecar container", pod.Name)
+
+			return false
+		}
+	}
+
+	return true
 }